@@ -0,0 +1,396 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Tetragon
+
+package metrics
+
+import (
+	"hash/fnv"
+	"regexp"
+	"sync"
+
+	"github.com/cilium/tetragon/pkg/logger"
+	"github.com/cilium/tetragon/pkg/option"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// placeholderLabelValue is substituted for label values that don't match a
+// configured allowlist/regex filter, so that operators can bound cardinality
+// without losing the metric entirely.
+const placeholderLabelValue = "__other__"
+
+var droppedSeriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tetragon_metrics_dropped_series_total",
+	Help: "Number of metric series dropped because a cardinality cap was reached.",
+}, []string{"metric"})
+
+func init() {
+	GetRegistry().MustRegister(droppedSeriesTotal)
+}
+
+// LabelValueFilter restricts which values are allowed for a given label. If
+// Allowlist or Regex is set and a value fails to match, the value is
+// collapsed to the placeholder label value instead of being exported
+// verbatim. An empty LabelValueFilter matches everything.
+type LabelValueFilter struct {
+	Allowlist []string
+	Regex     *regexp.Regexp
+}
+
+func (f *LabelValueFilter) allows(value string) bool {
+	if f == nil {
+		return true
+	}
+	for _, allowed := range f.Allowlist {
+		if allowed == value {
+			return true
+		}
+	}
+	if f.Regex != nil && f.Regex.MatchString(value) {
+		return true
+	}
+	return len(f.Allowlist) == 0 && f.Regex == nil
+}
+
+// cardinalityTracker bounds the number of distinct label-value tuples a
+// metric is allowed to export. Once MaxSeries tuples have been observed,
+// further unseen tuples are refused rather than tracked, which keeps the
+// underlying CounterVec/GaugeVec/HistogramVec from growing without bound.
+type cardinalityTracker struct {
+	metricName string
+	maxSeries  int
+	labels     []string
+	filters    map[string]*LabelValueFilter
+
+	mu   sync.Mutex
+	seen map[uint64]struct{}
+}
+
+func newCardinalityTracker(metricName string, labels []string, maxSeries int, filters map[string]*LabelValueFilter) *cardinalityTracker {
+	return &cardinalityTracker{
+		metricName: metricName,
+		maxSeries:  maxSeries,
+		labels:     labels,
+		filters:    filters,
+		seen:       make(map[uint64]struct{}),
+	}
+}
+
+// sanitize applies any configured per-label allowlist/regex filters,
+// collapsing disallowed values to the placeholder value.
+func (c *cardinalityTracker) sanitize(values []string) []string {
+	if len(c.filters) == 0 {
+		return values
+	}
+	out := make([]string, len(values))
+	copy(out, values)
+	for i, label := range c.labels {
+		if i >= len(out) {
+			break
+		}
+		if filter, ok := c.filters[label]; ok && !filter.allows(out[i]) {
+			out[i] = placeholderLabelValue
+		}
+	}
+	return out
+}
+
+// allow reports whether the given label-value tuple (after sanitization) may
+// be recorded. It hashes the tuple with fnv64a, similarly to how
+// statsd_exporter's registry keys its series cache.
+func (c *cardinalityTracker) allow(values []string) ([]string, bool) {
+	if c.maxSeries <= 0 {
+		return c.sanitize(values), true
+	}
+	sanitized := c.sanitize(values)
+	key := hashLabelValues(sanitized)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[key]; ok {
+		return sanitized, true
+	}
+	if len(c.seen) >= c.maxSeries {
+		return sanitized, false
+	}
+	c.seen[key] = struct{}{}
+	return sanitized, true
+}
+
+// hashLabelValues hashes values in the order given, which callers keep
+// positionally aligned with the metric's label names. Sorting them first
+// would make permutations of the same values (e.g. pod/namespace swapped
+// with each other) collide on the same hash.
+func hashLabelValues(values []string) uint64 {
+	h := fnv.New64a()
+	for _, v := range values {
+		_, _ = h.Write([]byte(v))
+		_, _ = h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+func (c *cardinalityTracker) dropped() {
+	droppedSeriesTotal.WithLabelValues(c.metricName).Inc()
+	logger.GetLogger().WithField("metric", c.metricName).Debug("Dropping metric series: cardinality cap reached")
+}
+
+// CardinalityOption configures the per-metric cardinality guard applied by
+// the WithPod metric constructors.
+type CardinalityOption func(*cardinalityConfig)
+
+type cardinalityConfig struct {
+	maxSeries int
+	filters   map[string]*LabelValueFilter
+}
+
+// WithMaxSeries caps the number of distinct label-value tuples a metric will
+// export. A value <= 0 falls back to option.Config.MetricsMaxCardinality.
+func WithMaxSeries(n int) CardinalityOption {
+	return func(c *cardinalityConfig) {
+		c.maxSeries = n
+	}
+}
+
+// WithLabelValueFilter restricts the values a given label may take; values
+// that don't match collapse to the placeholder label value.
+func WithLabelValueFilter(label string, filter *LabelValueFilter) CardinalityOption {
+	return func(c *cardinalityConfig) {
+		if c.filters == nil {
+			c.filters = make(map[string]*LabelValueFilter)
+		}
+		c.filters[label] = filter
+	}
+}
+
+func buildCardinalityConfig(opts []CardinalityOption) *cardinalityConfig {
+	cfg := &cardinalityConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// newTrackerFromOptions builds a cardinalityTracker for the given metric, or
+// returns nil if no cap was requested and the global default is disabled.
+func newTrackerFromOptions(metricName string, labels []string, opts []CardinalityOption) *cardinalityTracker {
+	cfg := buildCardinalityConfig(opts)
+	if cfg.maxSeries <= 0 {
+		cfg.maxSeries = option.Config.MetricsMaxCardinality
+	}
+	if cfg.maxSeries <= 0 && len(cfg.filters) == 0 {
+		return nil
+	}
+	return newCardinalityTracker(metricName, labels, cfg.maxSeries, cfg.filters)
+}
+
+// discardedCounter is returned in place of a real series once a metric's
+// cardinality cap has been reached, so callers can keep calling Inc()/Add()
+// without a nil-pointer panic.
+var discardedCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "tetragon_metrics_discarded_counter"})
+
+// discardedGauge is the Gauge equivalent of discardedCounter.
+var discardedGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "tetragon_metrics_discarded_gauge"})
+
+// discardedObserver is the Histogram equivalent of discardedCounter.
+var discardedObserver = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "tetragon_metrics_discarded_histogram"})
+
+// multiObserver forwards each write to every write-observing policy
+// registered on a metric.
+type multiObserver []writeObserver
+
+func (m multiObserver) touch(labelNames []string, labelValues []string) {
+	for _, o := range m {
+		o.touch(labelNames, labelValues)
+	}
+}
+
+// CounterVecWithPod wraps a *prometheus.CounterVec with an optional
+// cardinality guard and retention policies.
+type CounterVecWithPod struct {
+	*prometheus.CounterVec
+	labels   []string
+	tracker  *cardinalityTracker
+	observer writeObserver
+}
+
+// WithRetentionPolicy registers policy to evict stale series from this
+// metric, in addition to the default PodDeletePolicy that
+// NewCounterVecWithPod applies to metrics with "pod"/"namespace" labels. If
+// policy also wants to know about writes (e.g. TTLPolicy, LRUPolicy), it's
+// wired up to be touched on every WithLabelValues/With call.
+func (c *CounterVecWithPod) WithRetentionPolicy(policy RetentionPolicy) *CounterVecWithPod {
+	registerRetention(c.CounterVec.MetricVec, policy)
+	if observer, ok := policy.(writeObserver); ok {
+		if c.observer != nil {
+			observer = multiObserver{c.observer, observer}
+		}
+		c.observer = observer
+	}
+	return c
+}
+
+func (c *CounterVecWithPod) WithLabelValues(lvs ...string) prometheus.Counter {
+	sanitized := lvs
+	if c.tracker != nil {
+		var ok bool
+		sanitized, ok = c.tracker.allow(lvs)
+		if !ok {
+			c.tracker.dropped()
+			return discardedCounter
+		}
+	}
+	if c.observer != nil {
+		c.observer.touch(c.labels, sanitized)
+	}
+	return c.CounterVec.WithLabelValues(sanitized...)
+}
+
+func (c *CounterVecWithPod) With(labels prometheus.Labels) prometheus.Counter {
+	values := make([]string, len(c.labels))
+	for i, label := range c.labels {
+		values[i] = labels[label]
+	}
+	sanitized := values
+	if c.tracker != nil {
+		var ok bool
+		sanitized, ok = c.tracker.allow(values)
+		if !ok {
+			c.tracker.dropped()
+			return discardedCounter
+		}
+	}
+	sanitizedLabels := make(prometheus.Labels, len(labels))
+	for i, label := range c.labels {
+		sanitizedLabels[label] = sanitized[i]
+	}
+	if c.observer != nil {
+		c.observer.touch(c.labels, sanitized)
+	}
+	return c.CounterVec.With(sanitizedLabels)
+}
+
+// GaugeVecWithPod wraps a *prometheus.GaugeVec with an optional cardinality
+// guard and retention policies.
+type GaugeVecWithPod struct {
+	*prometheus.GaugeVec
+	labels   []string
+	tracker  *cardinalityTracker
+	observer writeObserver
+}
+
+// WithRetentionPolicy registers policy to evict stale series from this
+// metric, in addition to the default PodDeletePolicy that NewGaugeVecWithPod
+// applies to metrics with "pod"/"namespace" labels.
+func (g *GaugeVecWithPod) WithRetentionPolicy(policy RetentionPolicy) *GaugeVecWithPod {
+	registerRetention(g.GaugeVec.MetricVec, policy)
+	if observer, ok := policy.(writeObserver); ok {
+		if g.observer != nil {
+			observer = multiObserver{g.observer, observer}
+		}
+		g.observer = observer
+	}
+	return g
+}
+
+func (g *GaugeVecWithPod) WithLabelValues(lvs ...string) prometheus.Gauge {
+	sanitized := lvs
+	if g.tracker != nil {
+		var ok bool
+		sanitized, ok = g.tracker.allow(lvs)
+		if !ok {
+			g.tracker.dropped()
+			return discardedGauge
+		}
+	}
+	if g.observer != nil {
+		g.observer.touch(g.labels, sanitized)
+	}
+	return g.GaugeVec.WithLabelValues(sanitized...)
+}
+
+func (g *GaugeVecWithPod) With(labels prometheus.Labels) prometheus.Gauge {
+	values := make([]string, len(g.labels))
+	for i, label := range g.labels {
+		values[i] = labels[label]
+	}
+	sanitized := values
+	if g.tracker != nil {
+		var ok bool
+		sanitized, ok = g.tracker.allow(values)
+		if !ok {
+			g.tracker.dropped()
+			return discardedGauge
+		}
+	}
+	sanitizedLabels := make(prometheus.Labels, len(labels))
+	for i, label := range g.labels {
+		sanitizedLabels[label] = sanitized[i]
+	}
+	if g.observer != nil {
+		g.observer.touch(g.labels, sanitized)
+	}
+	return g.GaugeVec.With(sanitizedLabels)
+}
+
+// HistogramVecWithPod wraps a *prometheus.HistogramVec with an optional
+// cardinality guard and retention policies.
+type HistogramVecWithPod struct {
+	*prometheus.HistogramVec
+	labels   []string
+	tracker  *cardinalityTracker
+	observer writeObserver
+}
+
+// WithRetentionPolicy registers policy to evict stale series from this
+// metric, in addition to the default PodDeletePolicy that
+// NewHistogramVecWithPod applies to metrics with "pod"/"namespace" labels.
+func (h *HistogramVecWithPod) WithRetentionPolicy(policy RetentionPolicy) *HistogramVecWithPod {
+	registerRetention(h.HistogramVec.MetricVec, policy)
+	if observer, ok := policy.(writeObserver); ok {
+		if h.observer != nil {
+			observer = multiObserver{h.observer, observer}
+		}
+		h.observer = observer
+	}
+	return h
+}
+
+func (h *HistogramVecWithPod) WithLabelValues(lvs ...string) prometheus.Observer {
+	sanitized := lvs
+	if h.tracker != nil {
+		var ok bool
+		sanitized, ok = h.tracker.allow(lvs)
+		if !ok {
+			h.tracker.dropped()
+			return discardedObserver
+		}
+	}
+	if h.observer != nil {
+		h.observer.touch(h.labels, sanitized)
+	}
+	return h.HistogramVec.WithLabelValues(sanitized...)
+}
+
+func (h *HistogramVecWithPod) With(labels prometheus.Labels) prometheus.Observer {
+	values := make([]string, len(h.labels))
+	for i, label := range h.labels {
+		values[i] = labels[label]
+	}
+	sanitized := values
+	if h.tracker != nil {
+		var ok bool
+		sanitized, ok = h.tracker.allow(values)
+		if !ok {
+			h.tracker.dropped()
+			return discardedObserver
+		}
+	}
+	sanitizedLabels := make(prometheus.Labels, len(labels))
+	for i, label := range h.labels {
+		sanitizedLabels[label] = sanitized[i]
+	}
+	if h.observer != nil {
+		h.observer.touch(h.labels, sanitized)
+	}
+	return h.HistogramVec.With(sanitizedLabels)
+}
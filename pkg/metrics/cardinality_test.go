@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Tetragon
+
+package metrics
+
+import "testing"
+
+func TestHashLabelValuesPositional(t *testing.T) {
+	a := hashLabelValues([]string{"a", "b"})
+	b := hashLabelValues([]string{"b", "a"})
+	if a == b {
+		t.Fatalf("hashLabelValues(%q) == hashLabelValues(%q) = %d, want distinct hashes for permuted values", []string{"a", "b"}, []string{"b", "a"}, a)
+	}
+
+	same := hashLabelValues([]string{"a", "b"})
+	if a != same {
+		t.Fatalf("hashLabelValues is not deterministic: got %d and %d for the same input", a, same)
+	}
+}
+
+func TestCardinalityTrackerAllow(t *testing.T) {
+	tracker := newCardinalityTracker("test_metric", []string{"pod", "namespace"}, 2, nil)
+
+	if _, ok := tracker.allow([]string{"a", "b"}); !ok {
+		t.Fatalf("first series should be allowed")
+	}
+	if _, ok := tracker.allow([]string{"c", "d"}); !ok {
+		t.Fatalf("second distinct series should be allowed, cap is 2")
+	}
+	if _, ok := tracker.allow([]string{"a", "b"}); !ok {
+		t.Fatalf("an already-seen series should remain allowed once the cap is hit")
+	}
+	if _, ok := tracker.allow([]string{"e", "f"}); ok {
+		t.Fatalf("a third distinct series should be refused once the cap is hit")
+	}
+}
+
+func TestCardinalityTrackerLabelValueFilter(t *testing.T) {
+	filters := map[string]*LabelValueFilter{
+		"namespace": {Allowlist: []string{"kube-system"}},
+	}
+	tracker := newCardinalityTracker("test_metric", []string{"pod", "namespace"}, 0, filters)
+
+	sanitized, ok := tracker.allow([]string{"foo", "kube-system"})
+	if !ok || sanitized[1] != "kube-system" {
+		t.Fatalf("allowlisted value should pass through unchanged, got %v", sanitized)
+	}
+
+	sanitized, ok = tracker.allow([]string{"foo", "default"})
+	if !ok || sanitized[1] != placeholderLabelValue {
+		t.Fatalf("disallowed value should collapse to %q, got %v", placeholderLabelValue, sanitized)
+	}
+}
@@ -0,0 +1,246 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Tetragon
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Factory builds WithPod metrics and registers them at construction time,
+// the way promauto.Factory does for plain prometheus vecs. It closes the gap
+// between "create the vec" and "register it with the registry" that used to
+// let callers forget one or the other: registration errors are returned
+// (or panicked, for the Must variants) instead of being silently dropped,
+// and metrics whose label set contains "pod"/"namespace" are automatically
+// wired into the pod-cleanup retention policy.
+type Factory struct {
+	reg       prometheus.Registerer
+	namespace string
+	subsystem string
+}
+
+// NewFactory returns a Factory that registers metrics into reg.
+func NewFactory(reg prometheus.Registerer) Factory {
+	return Factory{reg: reg}
+}
+
+// DefaultFactory returns a Factory bound to GetRegistry(), the registry
+// served by the /metrics endpoint. It's what the package-level
+// NewCounterVecWithPod/NewGaugeVecWithPod/NewHistogramVecWithPod helpers use.
+func DefaultFactory() Factory {
+	return NewFactory(GetRegistry())
+}
+
+// WithNamespace returns a copy of f that defaults CounterOpts/GaugeOpts/HistogramOpts.Namespace
+// to ns for every metric it subsequently builds, so a subsystem doesn't have
+// to repeat it at every call site.
+func (f Factory) WithNamespace(ns string) Factory {
+	f.namespace = ns
+	return f
+}
+
+// WithSubsystem is the Subsystem equivalent of WithNamespace.
+func (f Factory) WithSubsystem(ss string) Factory {
+	f.subsystem = ss
+	return f
+}
+
+func hasPodLabels(labels []string) bool {
+	return slices.Contains(labels, "pod") && slices.Contains(labels, "namespace")
+}
+
+// registerOrReuse registers metric with reg, but if an equivalent collector
+// was already registered (e.g. by a call site that still MustRegister's its
+// own vec instead of going through the Factory) it returns that existing
+// collector instead of an error, so adopting the Factory can't turn a
+// pre-existing double-registration into a startup panic.
+func registerOrReuse[T prometheus.Collector](reg prometheus.Registerer, metric T) (T, error) {
+	if err := reg.Register(metric); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing, nil
+			}
+		}
+		var zero T
+		return zero, err
+	}
+	return metric, nil
+}
+
+var (
+	wrapperCacheMu sync.Mutex
+	wrapperCache   = make(map[prometheus.Collector]any)
+)
+
+// wrapOnce returns the cached WithPod wrapper for metric, building one via
+// build and caching it on the first call. registerOrReuse can hand back an
+// already-registered vec to a second call site constructing the same metric;
+// without this, that second call site would wrap the shared vec in its own
+// fresh wrapper, splitting the cardinality cap across two independent
+// trackers and registering the pod-cleanup retention policy for the same vec
+// twice. Keying by the vec itself (rather than by name) means two different
+// Factory instances registering into two different registries still get
+// independent wrappers.
+func wrapOnce[W any](metric prometheus.Collector, build func() W) W {
+	wrapperCacheMu.Lock()
+	defer wrapperCacheMu.Unlock()
+	if existing, ok := wrapperCache[metric]; ok {
+		return existing.(W)
+	}
+	wrapper := build()
+	wrapperCache[metric] = wrapper
+	return wrapper
+}
+
+// NewCounterVecWithPod builds and registers a CounterVec, applying
+// FilterMetricLabels to labels and wiring in the default pod-cleanup
+// retention policy if the (filtered) label set carries "pod"/"namespace".
+func (f Factory) NewCounterVecWithPod(opts prometheus.CounterOpts, labels []string, cardOpts ...CardinalityOption) (*CounterVecWithPod, error) {
+	return f.buildCounterVecWithPod(opts, FilterMetricLabels(labels...), cardOpts...)
+}
+
+// buildCounterVecWithPod is NewCounterVecWithPod without the FilterMetricLabels
+// step, for callers (namely the package-level NewCounterVecWithPod) that
+// already pass a pre-filtered label list.
+func (f Factory) buildCounterVecWithPod(opts prometheus.CounterOpts, labels []string, cardOpts ...CardinalityOption) (*CounterVecWithPod, error) {
+	if f.namespace != "" && opts.Namespace == "" {
+		opts.Namespace = f.namespace
+	}
+	if f.subsystem != "" && opts.Subsystem == "" {
+		opts.Subsystem = f.subsystem
+	}
+
+	metric, err := registerOrReuse(f.reg, prometheus.NewCounterVec(opts, labels))
+	if err != nil {
+		return nil, fmt.Errorf("registering counter %s: %w", opts.Name, err)
+	}
+	vec := wrapOnce[*CounterVecWithPod](metric, func() *CounterVecWithPod {
+		vec := &CounterVecWithPod{
+			CounterVec: metric,
+			labels:     labels,
+			tracker:    newTrackerFromOptions(opts.Name, labels, cardOpts),
+		}
+		if hasPodLabels(labels) {
+			registerRetention(metric.MetricVec, defaultPodDeletePolicy)
+		}
+		return vec
+	})
+	return vec, nil
+}
+
+// MustNewCounterVecWithPod is NewCounterVecWithPod, panicking on registration
+// or configuration errors (e.g. a name already registered with different
+// labels, help or metric type; an identical earlier registration is reused
+// instead, see registerOrReuse).
+func (f Factory) MustNewCounterVecWithPod(opts prometheus.CounterOpts, labels []string, cardOpts ...CardinalityOption) *CounterVecWithPod {
+	vec, err := f.NewCounterVecWithPod(opts, labels, cardOpts...)
+	if err != nil {
+		panic(err)
+	}
+	return vec
+}
+
+// NewGaugeVecWithPod is the Gauge equivalent of NewCounterVecWithPod.
+func (f Factory) NewGaugeVecWithPod(opts prometheus.GaugeOpts, labels []string, cardOpts ...CardinalityOption) (*GaugeVecWithPod, error) {
+	return f.buildGaugeVecWithPod(opts, FilterMetricLabels(labels...), cardOpts...)
+}
+
+// buildGaugeVecWithPod is NewGaugeVecWithPod without the FilterMetricLabels
+// step, for callers that already pass a pre-filtered label list.
+func (f Factory) buildGaugeVecWithPod(opts prometheus.GaugeOpts, labels []string, cardOpts ...CardinalityOption) (*GaugeVecWithPod, error) {
+	if f.namespace != "" && opts.Namespace == "" {
+		opts.Namespace = f.namespace
+	}
+	if f.subsystem != "" && opts.Subsystem == "" {
+		opts.Subsystem = f.subsystem
+	}
+
+	metric, err := registerOrReuse(f.reg, prometheus.NewGaugeVec(opts, labels))
+	if err != nil {
+		return nil, fmt.Errorf("registering gauge %s: %w", opts.Name, err)
+	}
+	vec := wrapOnce[*GaugeVecWithPod](metric, func() *GaugeVecWithPod {
+		vec := &GaugeVecWithPod{
+			GaugeVec: metric,
+			labels:   labels,
+			tracker:  newTrackerFromOptions(opts.Name, labels, cardOpts),
+		}
+		if hasPodLabels(labels) {
+			registerRetention(metric.MetricVec, defaultPodDeletePolicy)
+		}
+		return vec
+	})
+	return vec, nil
+}
+
+// MustNewGaugeVecWithPod is NewGaugeVecWithPod, panicking on registration or
+// configuration errors.
+func (f Factory) MustNewGaugeVecWithPod(opts prometheus.GaugeOpts, labels []string, cardOpts ...CardinalityOption) *GaugeVecWithPod {
+	vec, err := f.NewGaugeVecWithPod(opts, labels, cardOpts...)
+	if err != nil {
+		panic(err)
+	}
+	return vec
+}
+
+// NewHistogramVecWithPod is the Histogram equivalent of NewCounterVecWithPod.
+func (f Factory) NewHistogramVecWithPod(opts prometheus.HistogramOpts, labels []string, cardOpts ...CardinalityOption) (*HistogramVecWithPod, error) {
+	return f.buildHistogramVecWithPod(opts, FilterMetricLabels(labels...), cardOpts...)
+}
+
+// buildHistogramVecWithPod is NewHistogramVecWithPod without the
+// FilterMetricLabels step, for callers that already pass a pre-filtered
+// label list.
+func (f Factory) buildHistogramVecWithPod(opts prometheus.HistogramOpts, labels []string, cardOpts ...CardinalityOption) (*HistogramVecWithPod, error) {
+	if f.namespace != "" && opts.Namespace == "" {
+		opts.Namespace = f.namespace
+	}
+	if f.subsystem != "" && opts.Subsystem == "" {
+		opts.Subsystem = f.subsystem
+	}
+	applyNativeHistogramDefaults(&opts)
+
+	metric, err := registerOrReuse(f.reg, prometheus.NewHistogramVec(opts, labels))
+	if err != nil {
+		return nil, fmt.Errorf("registering histogram %s: %w", opts.Name, err)
+	}
+	vec := wrapOnce[*HistogramVecWithPod](metric, func() *HistogramVecWithPod {
+		vec := &HistogramVecWithPod{
+			HistogramVec: metric,
+			labels:       labels,
+			tracker:      newTrackerFromOptions(opts.Name, labels, cardOpts),
+		}
+		if hasPodLabels(labels) {
+			registerRetention(metric.MetricVec, defaultPodDeletePolicy)
+		}
+		return vec
+	})
+	return vec, nil
+}
+
+// MustNewHistogramVecWithPod is NewHistogramVecWithPod, panicking on
+// registration or configuration errors.
+func (f Factory) MustNewHistogramVecWithPod(opts prometheus.HistogramOpts, labels []string, cardOpts ...CardinalityOption) *HistogramVecWithPod {
+	vec, err := f.NewHistogramVecWithPod(opts, labels, cardOpts...)
+	if err != nil {
+		panic(err)
+	}
+	return vec
+}
+
+// NewHistogramVecWithPodPreset is NewHistogramVecWithPod, filling in
+// opts.Buckets from preset when the caller hasn't set their own.
+func (f Factory) NewHistogramVecWithPodPreset(preset BucketPreset, opts prometheus.HistogramOpts, labels []string, cardOpts ...CardinalityOption) (*HistogramVecWithPod, error) {
+	if opts.Buckets == nil {
+		opts.Buckets = preset.Buckets()
+	}
+	return f.NewHistogramVecWithPod(opts, labels, cardOpts...)
+}
@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Tetragon
+
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cilium/tetragon/pkg/option"
+)
+
+// BucketPreset selects a sensible set of default classic histogram buckets,
+// so call sites don't each hand-roll their own prometheus.ExponentialBuckets
+// call with slightly different parameters.
+type BucketPreset int
+
+const (
+	// BucketPresetLatency is tuned for sub-second to multi-second durations,
+	// e.g. event processing or syscall latency.
+	BucketPresetLatency BucketPreset = iota
+	// BucketPresetSize is tuned for byte sizes, e.g. event or message size.
+	BucketPresetSize
+	// BucketPresetCount is tuned for small unitless counts, e.g. batch sizes.
+	BucketPresetCount
+)
+
+// Buckets returns the default classic buckets for the preset.
+func (p BucketPreset) Buckets() []float64 {
+	switch p {
+	case BucketPresetLatency:
+		// 1ms to ~16s.
+		return prometheus.ExponentialBuckets(0.001, 2, 15)
+	case BucketPresetSize:
+		// 64B to 256MiB.
+		return prometheus.ExponentialBuckets(64, 4, 12)
+	case BucketPresetCount:
+		// 1 to ~4096.
+		return prometheus.ExponentialBuckets(1, 2, 13)
+	default:
+		return prometheus.DefBuckets
+	}
+}
+
+// NewHistogramVecWithPodPreset is NewHistogramVecWithPod, filling in
+// opts.Buckets from preset when the caller hasn't set their own, so call
+// sites don't need to hand-roll prometheus.ExponentialBuckets.
+func NewHistogramVecWithPodPreset(preset BucketPreset, opts prometheus.HistogramOpts, labels []string, cardOpts ...CardinalityOption) *HistogramVecWithPod {
+	if opts.Buckets == nil {
+		opts.Buckets = preset.Buckets()
+	}
+	return NewHistogramVecWithPod(opts, labels, cardOpts...)
+}
+
+// applyNativeHistogramDefaults fills in any unset native-histogram fields of
+// opts from option.Config, so operators can flip every Tetragon histogram to
+// sparse native histograms in one place instead of patching each call site.
+// If option.Config.MetricsNativeHistogramsEnabled is false, opts is left
+// untouched and the histogram stays classic-only.
+//
+// Enabling native histograms normally replaces a metric's classic buckets
+// outright. Setting option.Config.MetricsNativeHistogramsMigration instead
+// keeps the classic Buckets callers configured (e.g. via a BucketPreset)
+// alongside the native fields: the Prometheus client already emits both
+// representations for a histogram that has them both configured, which is
+// exactly the dual-emission compatibility shim a gradual, scrape-time
+// migration needs.
+func applyNativeHistogramDefaults(opts *prometheus.HistogramOpts) {
+	if !option.Config.MetricsNativeHistogramsEnabled {
+		return
+	}
+	if opts.NativeHistogramBucketFactor == 0 {
+		opts.NativeHistogramBucketFactor = option.Config.MetricsNativeHistogramBucketFactor
+	}
+	if opts.NativeHistogramMaxBucketNumber == 0 {
+		opts.NativeHistogramMaxBucketNumber = option.Config.MetricsNativeHistogramMaxBucketNumber
+	}
+	if opts.NativeHistogramMinResetDuration == 0 {
+		opts.NativeHistogramMinResetDuration = option.Config.MetricsNativeHistogramMinResetDuration
+	}
+	if !option.Config.MetricsNativeHistogramsMigration {
+		opts.Buckets = nil
+	}
+}
+
+// GranularHistogram mirrors GranularCounter: it defers building the
+// underlying HistogramVec until first use, automatically appending
+// Tetragon's known label filters and applying the configured native
+// histogram defaults.
+type GranularHistogram struct {
+	histogram     *HistogramVecWithPod
+	HistogramOpts prometheus.HistogramOpts
+	labels        []string
+	// MaxSeries caps the number of distinct label-value tuples this
+	// histogram will export. Zero falls back to option.Config.MetricsMaxCardinality.
+	MaxSeries int
+	// Preset, if set, supplies HistogramOpts.Buckets from a BucketPreset
+	// instead of requiring callers to hand-roll prometheus.ExponentialBuckets.
+	// It's ignored if HistogramOpts.Buckets is already set.
+	Preset   *BucketPreset
+	register sync.Once
+}
+
+// MustNewGranularHistogram builds a GranularHistogram, panicking if labels
+// contains any of consts.KnownMetricLabelFilters (those are added automatically).
+func MustNewGranularHistogram(opts prometheus.HistogramOpts, labels []string) *GranularHistogram {
+	return &GranularHistogram{
+		HistogramOpts: opts,
+		labels:        mustAppendKnownLabelFilters(labels),
+	}
+}
+
+// ToProm returns the underlying HistogramVec, building and registering it on
+// first call.
+func (m *GranularHistogram) ToProm() *HistogramVecWithPod {
+	m.register.Do(func() {
+		m.labels = FilterMetricLabels(m.labels...)
+		opts := m.HistogramOpts
+		if m.Preset != nil && opts.Buckets == nil {
+			opts.Buckets = m.Preset.Buckets()
+		}
+		m.histogram = NewHistogramVecWithPod(opts, m.labels, WithMaxSeries(m.MaxSeries))
+	})
+	return m.histogram
+}
@@ -4,6 +4,7 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"sync"
@@ -19,85 +20,93 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/util/workqueue"
 )
 
 var (
-	registry            *prometheus.Registry
-	registryOnce        sync.Once
-	metricsWithPod      []*prometheus.MetricVec
-	metricsWithPodMutex sync.RWMutex
-	podQueue            workqueue.DelayingInterface
-	podQueueOnce        sync.Once
-	deleteDelay         = 1 * time.Minute
+	registry     *prometheus.Registry
+	registryOnce sync.Once
 )
 
 type GranularCounter struct {
-	counter     *prometheus.CounterVec
+	counter     *CounterVecWithPod
 	CounterOpts prometheus.CounterOpts
 	labels      []string
-	register    sync.Once
+	// MaxSeries caps the number of distinct label-value tuples this counter
+	// will export. Zero falls back to option.Config.MetricsMaxCardinality.
+	MaxSeries int
+	register  sync.Once
 }
 
 func MustNewGranularCounter(opts prometheus.CounterOpts, labels []string) *GranularCounter {
+	return &GranularCounter{
+		CounterOpts: opts,
+		labels:      mustAppendKnownLabelFilters(labels),
+	}
+}
+
+// mustAppendKnownLabelFilters appends consts.KnownMetricLabelFilters to labels,
+// panicking if labels already contains one of them; they're added
+// automatically by the Granular* metric types and must not be passed in twice.
+func mustAppendKnownLabelFilters(labels []string) []string {
 	for _, label := range labels {
 		if slices.Contains(consts.KnownMetricLabelFilters, label) {
-			panic(fmt.Sprintf("labels passed to GranularCounter can't contain any of the following: %v. These labels are added by Tetragon.", consts.KnownMetricLabelFilters))
+			panic(fmt.Sprintf("labels passed to a Granular metric can't contain any of the following: %v. These labels are added by Tetragon.", consts.KnownMetricLabelFilters))
 		}
 	}
-	return &GranularCounter{
-		CounterOpts: opts,
-		labels:      append(labels, consts.KnownMetricLabelFilters...),
-	}
+	return append(labels, consts.KnownMetricLabelFilters...)
 }
 
-func (m *GranularCounter) ToProm() *prometheus.CounterVec {
+func (m *GranularCounter) ToProm() *CounterVecWithPod {
 	m.register.Do(func() {
 		m.labels = FilterMetricLabels(m.labels...)
-		m.counter = NewCounterVecWithPod(m.CounterOpts, m.labels)
+		m.counter = NewCounterVecWithPod(m.CounterOpts, m.labels, WithMaxSeries(m.MaxSeries))
 	})
 	return m.counter
 }
 
-// NewCounterVecWithPod is a wrapper around prometheus.NewCounterVec that also registers the metric
-// to be cleaned up when a pod is deleted. It should be used only to register metrics that have
-// "pod" and "namespace" labels.
-func NewCounterVecWithPod(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
-	metric := prometheus.NewCounterVec(opts, labels)
-	metricsWithPodMutex.Lock()
-	metricsWithPod = append(metricsWithPod, metric.MetricVec)
-	metricsWithPodMutex.Unlock()
-	return metric
+// NewCounterVecWithPod is a wrapper around prometheus.NewCounterVec that registers the metric
+// with GetRegistry() and arranges for it to be cleaned up when a pod is deleted. It should be
+// used only to register metrics that have "pod" and "namespace" labels, with those labels already
+// filtered via FilterMetricLabels. Passing CardinalityOption(s) bounds the number of label-value
+// tuples the metric will export; once the cap is hit, WithLabelValues/With refuse further series.
+// Panics if the metric can't be registered (e.g. a name already registered with different labels,
+// help or metric type; an identical earlier registration is reused instead); callers who want the error back
+// should use DefaultFactory().NewCounterVecWithPod instead.
+func NewCounterVecWithPod(opts prometheus.CounterOpts, labels []string, cardOpts ...CardinalityOption) *CounterVecWithPod {
+	vec, err := DefaultFactory().buildCounterVecWithPod(opts, labels, cardOpts...)
+	if err != nil {
+		panic(err)
+	}
+	return vec
 }
 
-// NewGaugeVecWithPod is a wrapper around prometheus.NewGaugeVec that also registers the metric
-// to be cleaned up when a pod is deleted. It should be used only to register metrics that have
-// "pod" and "namespace" labels.
-func NewGaugeVecWithPod(opts prometheus.GaugeOpts, labels []string) *prometheus.GaugeVec {
-	metric := prometheus.NewGaugeVec(opts, labels)
-	metricsWithPodMutex.Lock()
-	metricsWithPod = append(metricsWithPod, metric.MetricVec)
-	metricsWithPodMutex.Unlock()
-	return metric
+// NewGaugeVecWithPod is the Gauge equivalent of NewCounterVecWithPod.
+func NewGaugeVecWithPod(opts prometheus.GaugeOpts, labels []string, cardOpts ...CardinalityOption) *GaugeVecWithPod {
+	vec, err := DefaultFactory().buildGaugeVecWithPod(opts, labels, cardOpts...)
+	if err != nil {
+		panic(err)
+	}
+	return vec
 }
 
-// NewHistogramVecWithPod is a wrapper around prometheus.NewHistogramVec that also registers the metric
-// to be cleaned up when a pod is deleted. It should be used only to register metrics that have
-// "pod" and "namespace" labels.
-func NewHistogramVecWithPod(opts prometheus.HistogramOpts, labels []string) *prometheus.HistogramVec {
-	metric := prometheus.NewHistogramVec(opts, labels)
-	metricsWithPodMutex.Lock()
-	metricsWithPod = append(metricsWithPod, metric.MetricVec)
-	metricsWithPodMutex.Unlock()
-	return metric
+// NewHistogramVecWithPod is the Histogram equivalent of NewCounterVecWithPod.
+func NewHistogramVecWithPod(opts prometheus.HistogramOpts, labels []string, cardOpts ...CardinalityOption) *HistogramVecWithPod {
+	vec, err := DefaultFactory().buildHistogramVecWithPod(opts, labels, cardOpts...)
+	if err != nil {
+		panic(err)
+	}
+	return vec
 }
 
-// RegisterPodDeleteHandler registers handler for deleting metrics associated
-// with deleted pods. Without it, Tetragon kept exposing stale metrics for
+// RegisterPodDeleteHandler registers a handler that schedules metrics
+// associated with a deleted pod for eviction by defaultPodDeletePolicy, and
+// makes sure the retention manager that actually drains those scheduled
+// deletions is running. Without it, Tetragon kept exposing stale metrics for
 // deleted pods. This was causing continuous increase in memory usage in
 // Tetragon agent as well as in the metrics scraper.
 func RegisterPodDeleteHandler() {
 	logger.GetLogger().Info("Registering pod delete handler for metrics")
+	ensureRetentionManagerStarted()
 	podhooks.RegisterCallbacksAtInit(podhooks.Callbacks{
 		PodCallbacks: func(podInformer cache.SharedIndexInformer) {
 			podInformer.AddEventHandler(
@@ -118,8 +127,7 @@ func RegisterPodDeleteHandler() {
 						default:
 							return
 						}
-						queue := GetPodQueue()
-						queue.AddAfter(pod, deleteDelay)
+						defaultPodDeletePolicy.scheduleDelete(pod)
 					},
 				},
 			)
@@ -127,28 +135,6 @@ func RegisterPodDeleteHandler() {
 	})
 }
 
-func GetPodQueue() workqueue.DelayingInterface {
-	podQueueOnce.Do(func() {
-		podQueue = workqueue.NewDelayingQueue()
-	})
-	return podQueue
-}
-
-func DeleteMetricsForPod(pod *corev1.Pod) {
-	for _, metric := range ListMetricsWithPod() {
-		metric.DeletePartialMatch(prometheus.Labels{
-			"pod":       pod.Name,
-			"namespace": pod.Namespace,
-		})
-	}
-}
-
-func ListMetricsWithPod() []*prometheus.MetricVec {
-	// NB: All additions to the list happen when registering metrics, so it's safe to just return
-	// the list here.
-	return metricsWithPod
-}
-
 func GetRegistry() *prometheus.Registry {
 	registryOnce.Do(func() {
 		registry = prometheus.NewRegistry()
@@ -156,23 +142,66 @@ func GetRegistry() *prometheus.Registry {
 	return registry
 }
 
-func StartPodDeleteHandler() {
-	queue := GetPodQueue()
-	for {
-		pod, quit := queue.Get()
-		if quit {
+// EnableMetrics starts the Prometheus /metrics HTTP server and, if an OTLP
+// endpoint was configured, the OTLP push bridge alongside it; the HTTP
+// server (and OTLP bridge, if any) are stopped when ctx is canceled, so
+// callers should run EnableMetrics in its own goroutine. It also makes sure
+// the retention manager is running, same as RegisterPodDeleteHandler, since
+// either can be the first (or only) one called.
+func EnableMetrics(ctx context.Context, address string) error {
+	reg := GetRegistry()
+
+	ensureRetentionManagerStarted()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	srv := &http.Server{Addr: address, Handler: mux}
+
+	stopOTLP, err := maybeStartOTLPExporter(ctx)
+	if err != nil {
+		return fmt.Errorf("starting OTLP metrics exporter: %w", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		logger.GetLogger().WithField("addr", address).Info("Starting metrics server")
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errCh <- err
 			return
 		}
-		DeleteMetricsForPod(pod.(*corev1.Pod))
+		errCh <- nil
+	}()
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if stopOTLP != nil {
+			if err := stopOTLP(shutdownCtx); err != nil {
+				logger.GetLogger().WithError(err).Warn("Failed to shut down OTLP metrics exporter")
+			}
+		}
+		return srv.Shutdown(shutdownCtx)
+	case err := <-errCh:
+		return err
 	}
 }
 
-func EnableMetrics(address string) {
-	reg := GetRegistry()
-
-	logger.GetLogger().WithField("addr", address).Info("Starting metrics server")
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
-	http.ListenAndServe(address, nil)
+// maybeStartOTLPExporter starts the OTLP push bridge when an endpoint has
+// been configured via --metrics-otlp-endpoint (and friends), returning a nil
+// stop function otherwise.
+func maybeStartOTLPExporter(ctx context.Context) (func(context.Context) error, error) {
+	endpoint := option.Config.MetricsOTLPEndpoint
+	if endpoint == "" {
+		return nil, nil
+	}
+	cfg := OTLPConfig{
+		Endpoint: endpoint,
+		Protocol: OTLPProtocol(option.Config.MetricsOTLPProtocol),
+		Interval: option.Config.MetricsOTLPInterval,
+		Headers:  option.Config.MetricsOTLPHeaders,
+	}
+	return StartOTLPExporter(ctx, cfg)
 }
 
 // The FilterMetricLabels func takes in string arguments and returns a slice of those strings omitting the labels it is not configured for.
@@ -0,0 +1,252 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Tetragon
+
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/cilium/tetragon/pkg/logger"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// OTLPProtocol selects the wire protocol used to push metrics to an OTel
+// collector.
+type OTLPProtocol string
+
+const (
+	OTLPProtocolGRPC OTLPProtocol = "grpc"
+	OTLPProtocolHTTP OTLPProtocol = "http"
+)
+
+// OTLPConfig configures the OTel exporter bridge started alongside the
+// Prometheus /metrics endpoint.
+type OTLPConfig struct {
+	// Endpoint is the OTLP collector address, e.g. "localhost:4317".
+	Endpoint string
+	// Protocol selects OTLPProtocolGRPC or OTLPProtocolHTTP.
+	Protocol OTLPProtocol
+	// Interval is how often the Prometheus registry is scraped and pushed.
+	Interval time.Duration
+	// Headers are added to every export request (e.g. for auth).
+	Headers map[string]string
+	// TLS, if non-nil, is used for the OTLP connection instead of insecure transport.
+	TLS *tls.Config
+}
+
+// otlpExporter is a bridge that periodically gathers the Prometheus registry
+// and re-exports each MetricFamily as OTel Sum/Gauge/Histogram data points.
+// It runs alongside the existing /metrics HTTP endpoint so users can pull and
+// push metrics at the same time.
+type otlpExporter struct {
+	cfg      OTLPConfig
+	reg      prometheusGatherer
+	exporter otelPushExporter
+}
+
+// prometheusGatherer is the subset of *prometheus.Registry used by the
+// exporter; narrowed to make the bridge easy to test.
+type prometheusGatherer interface {
+	Gather() ([]*dto.MetricFamily, error)
+}
+
+// otelPushExporter abstracts over the OTLP gRPC/HTTP metric exporters so the
+// bridge doesn't care which protocol was configured.
+type otelPushExporter interface {
+	Export(ctx context.Context, rm *metricdata.ResourceMetrics) error
+	Shutdown(ctx context.Context) error
+}
+
+// newOTLPExporter builds the configured OTLP exporter. The concrete
+// otlpmetricgrpc/otlpmetrichttp client is constructed here so the rest of the
+// bridge only depends on the otelPushExporter interface.
+func newOTLPExporter(ctx context.Context, cfg OTLPConfig) (otelPushExporter, error) {
+	switch cfg.Protocol {
+	case OTLPProtocolHTTP:
+		return newOTLPHTTPExporter(ctx, cfg)
+	case OTLPProtocolGRPC, "":
+		return newOTLPGRPCExporter(ctx, cfg)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q", cfg.Protocol)
+	}
+}
+
+// StartOTLPExporter starts the Prometheus -> OTLP bridge on an interval,
+// returning a stop function that flushes and shuts the exporter down. It does
+// not replace the Prometheus /metrics endpoint; both run simultaneously.
+func StartOTLPExporter(ctx context.Context, cfg OTLPConfig) (func(context.Context) error, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Second
+	}
+
+	exporter, err := newOTLPExporter(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("building OTLP exporter: %w", err)
+	}
+
+	bridge := &otlpExporter{
+		cfg:      cfg,
+		reg:      GetRegistry(),
+		exporter: exporter,
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	done := make(chan struct{})
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := bridge.pushOnce(ctx); err != nil {
+					logger.GetLogger().WithError(err).Warn("Failed to export metrics via OTLP")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	stop := func(shutdownCtx context.Context) error {
+		close(done)
+		return exporter.Shutdown(shutdownCtx)
+	}
+	return stop, nil
+}
+
+func (b *otlpExporter) pushOnce(ctx context.Context) error {
+	families, err := b.reg.Gather()
+	if err != nil {
+		return fmt.Errorf("gathering prometheus registry: %w", err)
+	}
+	rm := translateMetricFamilies(families)
+	return b.exporter.Export(ctx, rm)
+}
+
+// translateMetricFamilies converts gathered dto.MetricFamily entries into an
+// OTel ResourceMetrics, preserving labels as attributes. FilterMetricLabels
+// has already been applied by the time metrics reach the registry, so no
+// additional label filtering happens here.
+func translateMetricFamilies(families []*dto.MetricFamily) *metricdata.ResourceMetrics {
+	scope := metricdata.ScopeMetrics{
+		Metrics: make([]metricdata.Metrics, 0, len(families)),
+	}
+
+	for _, family := range families {
+		m, ok := translateMetricFamily(family)
+		if !ok {
+			continue
+		}
+		scope.Metrics = append(scope.Metrics, m)
+	}
+
+	return &metricdata.ResourceMetrics{
+		ScopeMetrics: []metricdata.ScopeMetrics{scope},
+	}
+}
+
+func translateMetricFamily(family *dto.MetricFamily) (metricdata.Metrics, bool) {
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		return metricdata.Metrics{
+			Name: family.GetName(),
+			Data: metricdata.Sum[float64]{
+				DataPoints:  counterDataPoints(family),
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+			},
+		}, true
+	case dto.MetricType_GAUGE:
+		return metricdata.Metrics{
+			Name: family.GetName(),
+			Data: metricdata.Gauge[float64]{
+				DataPoints: gaugeDataPoints(family),
+			},
+		}, true
+	case dto.MetricType_HISTOGRAM:
+		return metricdata.Metrics{
+			Name: family.GetName(),
+			Data: metricdata.Histogram[float64]{
+				DataPoints:  histogramDataPoints(family),
+				Temporality: metricdata.CumulativeTemporality,
+			},
+		}, true
+	default:
+		// Summaries and untyped metrics have no clean OTel mapping; skip
+		// them rather than emit a lossy approximation.
+		return metricdata.Metrics{}, false
+	}
+}
+
+func toAttributes(labels []*dto.LabelPair) attribute.Set {
+	kvs := make([]attribute.KeyValue, 0, len(labels))
+	for _, label := range labels {
+		kvs = append(kvs, attribute.String(label.GetName(), label.GetValue()))
+	}
+	return attribute.NewSet(kvs...)
+}
+
+func counterDataPoints(family *dto.MetricFamily) []metricdata.DataPoint[float64] {
+	now := time.Now()
+	points := make([]metricdata.DataPoint[float64], 0, len(family.GetMetric()))
+	for _, m := range family.GetMetric() {
+		points = append(points, metricdata.DataPoint[float64]{
+			Attributes: toAttributes(m.GetLabel()),
+			StartTime:  now,
+			Time:       now,
+			Value:      m.GetCounter().GetValue(),
+		})
+	}
+	return points
+}
+
+func gaugeDataPoints(family *dto.MetricFamily) []metricdata.DataPoint[float64] {
+	now := time.Now()
+	points := make([]metricdata.DataPoint[float64], 0, len(family.GetMetric()))
+	for _, m := range family.GetMetric() {
+		points = append(points, metricdata.DataPoint[float64]{
+			Attributes: toAttributes(m.GetLabel()),
+			StartTime:  now,
+			Time:       now,
+			Value:      m.GetGauge().GetValue(),
+		})
+	}
+	return points
+}
+
+// histogramDataPoints converts Prometheus' cumulative per-bucket counts into
+// the non-cumulative counts OTel's HistogramDataPoint expects, appending the
+// implicit +Inf overflow bucket so len(BucketCounts) == len(Bounds)+1.
+func histogramDataPoints(family *dto.MetricFamily) []metricdata.HistogramDataPoint[float64] {
+	now := time.Now()
+	points := make([]metricdata.HistogramDataPoint[float64], 0, len(family.GetMetric()))
+	for _, m := range family.GetMetric() {
+		h := m.GetHistogram()
+		buckets := h.GetBucket()
+		bounds := make([]float64, 0, len(buckets))
+		counts := make([]uint64, 0, len(buckets)+1)
+		var lastCumulative uint64
+		for _, bucket := range buckets {
+			bounds = append(bounds, bucket.GetUpperBound())
+			cumulative := bucket.GetCumulativeCount()
+			counts = append(counts, cumulative-lastCumulative)
+			lastCumulative = cumulative
+		}
+		counts = append(counts, h.GetSampleCount()-lastCumulative)
+		points = append(points, metricdata.HistogramDataPoint[float64]{
+			Attributes:   toAttributes(m.GetLabel()),
+			StartTime:    now,
+			Time:         now,
+			Count:        h.GetSampleCount(),
+			Sum:          h.GetSampleSum(),
+			Bounds:       bounds,
+			BucketCounts: counts,
+		})
+	}
+	return points
+}
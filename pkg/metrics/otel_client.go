@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Tetragon
+
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"google.golang.org/grpc/credentials"
+)
+
+// newOTLPGRPCExporter builds an OTLP/gRPC metric exporter from the bridge
+// config. It satisfies otelPushExporter directly, since the generated
+// exporter types already implement Export/Shutdown.
+func newOTLPGRPCExporter(ctx context.Context, cfg OTLPConfig) (otelPushExporter, error) {
+	opts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpoint(cfg.Endpoint),
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlpmetricgrpc.WithHeaders(cfg.Headers))
+	}
+	opts = append(opts, tlsGRPCOption(cfg.TLS))
+
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+// newOTLPHTTPExporter builds an OTLP/HTTP metric exporter from the bridge
+// config.
+func newOTLPHTTPExporter(ctx context.Context, cfg OTLPConfig) (otelPushExporter, error) {
+	opts := []otlpmetrichttp.Option{
+		otlpmetrichttp.WithEndpoint(cfg.Endpoint),
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlpmetrichttp.WithHeaders(cfg.Headers))
+	}
+	opts = append(opts, tlsHTTPOption(cfg.TLS))
+
+	return otlpmetrichttp.New(ctx, opts...)
+}
+
+func tlsGRPCOption(cfg *tls.Config) otlpmetricgrpc.Option {
+	if cfg == nil {
+		return otlpmetricgrpc.WithInsecure()
+	}
+	return otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(cfg))
+}
+
+func tlsHTTPOption(cfg *tls.Config) otlpmetrichttp.Option {
+	if cfg == nil {
+		return otlpmetrichttp.WithInsecure()
+	}
+	return otlpmetrichttp.WithTLSClientConfig(cfg)
+}
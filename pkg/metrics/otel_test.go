@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Tetragon
+
+package metrics
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func f64(v float64) *float64 { return &v }
+func u64(v uint64) *uint64   { return &v }
+
+func TestHistogramDataPointsCumulativeToDelta(t *testing.T) {
+	family := &dto.MetricFamily{
+		Metric: []*dto.Metric{
+			{
+				Histogram: &dto.Histogram{
+					SampleCount: u64(10),
+					SampleSum:   f64(42),
+					Bucket: []*dto.Bucket{
+						{UpperBound: f64(0.1), CumulativeCount: u64(2)},
+						{UpperBound: f64(1), CumulativeCount: u64(7)},
+						{UpperBound: f64(10), CumulativeCount: u64(9)},
+					},
+				},
+			},
+		},
+	}
+
+	points := histogramDataPoints(family)
+	if len(points) != 1 {
+		t.Fatalf("got %d data points, want 1", len(points))
+	}
+	point := points[0]
+
+	if len(point.Bounds) != 3 {
+		t.Fatalf("got %d bounds, want 3", len(point.Bounds))
+	}
+	if len(point.BucketCounts) != len(point.Bounds)+1 {
+		t.Fatalf("got %d bucket counts, want len(Bounds)+1 = %d", len(point.BucketCounts), len(point.Bounds)+1)
+	}
+
+	wantCounts := []uint64{2, 5, 2, 1}
+	for i, want := range wantCounts {
+		if point.BucketCounts[i] != want {
+			t.Errorf("BucketCounts[%d] = %d, want %d (non-cumulative)", i, point.BucketCounts[i], want)
+		}
+	}
+
+	if point.Count != 10 {
+		t.Errorf("Count = %d, want 10", point.Count)
+	}
+	if point.Sum != 42 {
+		t.Errorf("Sum = %v, want 42", point.Sum)
+	}
+	if point.Time.IsZero() || point.StartTime.IsZero() {
+		t.Errorf("Time/StartTime must be set, got Time=%v StartTime=%v", point.Time, point.StartTime)
+	}
+}
@@ -0,0 +1,357 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Tetragon
+
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// retentionInterval is how often StartRetentionManager asks every registered
+// policy to evict stale series.
+var retentionInterval = 1 * time.Minute
+
+// deleteDelay is how long PodDeletePolicy waits after a pod is deleted
+// before evicting its series, giving any in-flight events a chance to land.
+var deleteDelay = 1 * time.Minute
+
+// RetentionPolicy decides which series of a registered metric have gone
+// stale and removes them. Implementations are invoked periodically by
+// StartRetentionManager's background goroutine; they decide for themselves,
+// from whatever state they track, which series (if any) to evict this tick.
+type RetentionPolicy interface {
+	Evict(metric *prometheus.MetricVec)
+}
+
+// writeObserver is implemented by retention policies that need to know when
+// a series was written to, such as TTLPolicy and LRUPolicy. PodDeletePolicy
+// doesn't need this since it reacts to pod-delete events instead.
+type writeObserver interface {
+	touch(labelNames []string, labelValues []string)
+}
+
+// tickBegin is an optional interface a RetentionPolicy can implement to
+// snapshot once-per-tick state before Evict is called for any metric it's
+// registered against. PodDeletePolicy uses this so that every metric in a
+// tick evicts the same due set, instead of each Evict call (and the later
+// onTickComplete) independently recomputing "due" against a slightly later
+// time.Now() and racing against new deletions becoming due mid-tick.
+type tickBegin interface {
+	onTickBegin()
+}
+
+// tickComplete is an optional interface a RetentionPolicy can implement to
+// run once-per-tick bookkeeping after Evict has been called for every metric
+// it's registered against. PodDeletePolicy uses this to retire pending
+// deletions exactly once per tick rather than once per metric.
+type tickComplete interface {
+	onTickComplete()
+}
+
+type retentionEntry struct {
+	metric *prometheus.MetricVec
+	policy RetentionPolicy
+}
+
+var (
+	retentionRegistry      []retentionEntry
+	retentionRegistryMutex sync.RWMutex
+)
+
+// registerRetention associates metric with policy so StartRetentionManager
+// evicts stale series from it on every tick. A metric may be registered with
+// more than one policy, e.g. the default PodDeletePolicy plus a TTLPolicy.
+func registerRetention(metric *prometheus.MetricVec, policy RetentionPolicy) {
+	retentionRegistryMutex.Lock()
+	defer retentionRegistryMutex.Unlock()
+	retentionRegistry = append(retentionRegistry, retentionEntry{metric: metric, policy: policy})
+}
+
+var retentionManagerOnce sync.Once
+
+// ensureRetentionManagerStarted starts the background retention manager the
+// first time it's called. It runs for the lifetime of the process rather
+// than being tied to the /metrics HTTP listener's context, so that
+// RegisterPodDeleteHandler's scheduled deletions are drained even when the
+// Prometheus endpoint is never enabled; calling it more than once (e.g. from
+// both RegisterPodDeleteHandler and EnableMetrics) only starts one manager.
+func ensureRetentionManagerStarted() {
+	retentionManagerOnce.Do(func() {
+		go StartRetentionManager(context.Background())
+	})
+}
+
+// StartRetentionManager runs a single background goroutine that periodically
+// dispatches every registered (metric, policy) pair to policy.Evict(metric).
+// It replaces the old pod-only StartPodDeleteHandler and also drives
+// TTL-based and LRU eviction for metrics registered with those policies.
+func StartRetentionManager(ctx context.Context) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runRetentionPass()
+		}
+	}
+}
+
+func runRetentionPass() {
+	retentionRegistryMutex.RLock()
+	entries := make([]retentionEntry, len(retentionRegistry))
+	copy(entries, retentionRegistry)
+	retentionRegistryMutex.RUnlock()
+
+	policies := make(map[RetentionPolicy]struct{})
+	for _, entry := range entries {
+		policies[entry.policy] = struct{}{}
+	}
+
+	// Snapshot once-per-tick state (e.g. PodDeletePolicy's due set) before
+	// any Evict call, so every metric this tick evicts exactly the same set
+	// and onTickComplete retires exactly that set afterward.
+	for policy := range policies {
+		if tb, ok := policy.(tickBegin); ok {
+			tb.onTickBegin()
+		}
+	}
+
+	for _, entry := range entries {
+		entry.policy.Evict(entry.metric)
+	}
+
+	for policy := range policies {
+		if tc, ok := policy.(tickComplete); ok {
+			tc.onTickComplete()
+		}
+	}
+}
+
+// pendingPodDeletion is a pod whose series are scheduled for eviction once
+// deleteDelay has elapsed.
+type pendingPodDeletion struct {
+	pod       string
+	namespace string
+	readyAt   time.Time
+}
+
+// PodDeletePolicy is the default RetentionPolicy applied to every metric
+// created via the WithPod constructors: when a pod is deleted from the
+// cluster, its series are evicted from every metric carrying "pod" and
+// "namespace" labels. Without it, Tetragon kept exposing stale metrics for
+// deleted pods, causing continuous memory growth in the agent and in the
+// metrics scraper.
+type PodDeletePolicy struct {
+	mu      sync.Mutex
+	pending []pendingPodDeletion
+	// due is the snapshot of pending entries whose readyAt had elapsed as of
+	// this tick's onTickBegin call. Evict and onTickComplete both act on
+	// this same snapshot instead of each recomputing it against its own
+	// time.Now(), so a pod's deletion can't be evicted from some metrics but
+	// not others because it crossed readyAt mid-tick.
+	due []pendingPodDeletion
+}
+
+// NewPodDeletePolicy returns a new, empty PodDeletePolicy.
+func NewPodDeletePolicy() *PodDeletePolicy {
+	return &PodDeletePolicy{}
+}
+
+// defaultPodDeletePolicy is shared by every metric registered through the
+// WithPod constructors, matching the previous behavior where a single
+// pod-delete handler cleaned up all of them.
+var defaultPodDeletePolicy = NewPodDeletePolicy()
+
+func (p *PodDeletePolicy) scheduleDelete(pod *corev1.Pod) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, pendingPodDeletion{
+		pod:       pod.Name,
+		namespace: pod.Namespace,
+		readyAt:   time.Now().Add(deleteDelay),
+	})
+}
+
+// onTickBegin snapshots which pending deletions have elapsed their delay as
+// of now, once per tick. Evict and onTickComplete both consult this snapshot
+// rather than recomputing it, so they agree on exactly which pods are due
+// this tick.
+func (p *PodDeletePolicy) onTickBegin() {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.due = p.due[:0]
+	for _, d := range p.pending {
+		if !d.readyAt.After(now) {
+			p.due = append(p.due, d)
+		}
+	}
+}
+
+// Evict deletes series for every pod in this tick's due snapshot. It doesn't
+// mutate the pending list itself, since it may be called once per metric
+// this policy is registered against; onTickComplete retires the due entries
+// after every metric has seen them.
+func (p *PodDeletePolicy) Evict(metric *prometheus.MetricVec) {
+	p.mu.Lock()
+	due := make([]pendingPodDeletion, len(p.due))
+	copy(due, p.due)
+	p.mu.Unlock()
+
+	for _, d := range due {
+		metric.DeletePartialMatch(prometheus.Labels{
+			"pod":       d.pod,
+			"namespace": d.namespace,
+		})
+	}
+}
+
+func (p *PodDeletePolicy) onTickComplete() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.due) == 0 {
+		return
+	}
+	due := make(map[pendingPodDeletion]struct{}, len(p.due))
+	for _, d := range p.due {
+		due[d] = struct{}{}
+	}
+	remaining := p.pending[:0]
+	for _, d := range p.pending {
+		if _, ok := due[d]; !ok {
+			remaining = append(remaining, d)
+		}
+	}
+	p.pending = remaining
+	p.due = nil
+}
+
+// TTLPolicy evicts series that haven't been written to for longer than TTL.
+// Metrics are kept honest via touch, which the WithPod wrapper types call on
+// every WithLabelValues/With. This bounds memory growth from non-pod labels
+// (binary, syscall, workload, ...) and works in non-k8s deployments where the
+// pod informer never fires.
+type TTLPolicy struct {
+	ttl time.Duration
+
+	mu          sync.Mutex
+	lastTouched map[uint64]ttlEntry
+}
+
+type ttlEntry struct {
+	labels    prometheus.Labels
+	touchedAt time.Time
+}
+
+// NewTTLPolicy returns a TTLPolicy that evicts series last written to more
+// than ttl ago.
+func NewTTLPolicy(ttl time.Duration) *TTLPolicy {
+	return &TTLPolicy{
+		ttl:         ttl,
+		lastTouched: make(map[uint64]ttlEntry),
+	}
+}
+
+func (t *TTLPolicy) touch(labelNames []string, labelValues []string) {
+	key := hashLabelValues(labelValues)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastTouched[key] = ttlEntry{
+		labels:    namedLabels(labelNames, labelValues),
+		touchedAt: time.Now(),
+	}
+}
+
+// Evict removes every series whose last write is older than t.ttl.
+func (t *TTLPolicy) Evict(metric *prometheus.MetricVec) {
+	now := time.Now()
+	t.mu.Lock()
+	var stale []prometheus.Labels
+	for key, entry := range t.lastTouched {
+		if now.Sub(entry.touchedAt) > t.ttl {
+			stale = append(stale, entry.labels)
+			delete(t.lastTouched, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, labels := range stale {
+		metric.DeletePartialMatch(labels)
+	}
+}
+
+// LRUPolicy bounds a metric to at most max distinct label-value tuples,
+// evicting the least-recently-touched series once the cap is exceeded.
+type LRUPolicy struct {
+	max int
+
+	mu     sync.Mutex
+	order  []uint64
+	labels map[uint64]prometheus.Labels
+}
+
+// NewLRUPolicy returns an LRUPolicy bounding a metric to max series.
+func NewLRUPolicy(max int) *LRUPolicy {
+	return &LRUPolicy{
+		max:    max,
+		labels: make(map[uint64]prometheus.Labels),
+	}
+}
+
+func (l *LRUPolicy) touch(labelNames []string, labelValues []string) {
+	key := hashLabelValues(labelValues)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.labels[key]; ok {
+		l.moveToMostRecentlyUsedLocked(key)
+		return
+	}
+	l.labels[key] = namedLabels(labelNames, labelValues)
+	l.order = append(l.order, key)
+}
+
+func (l *LRUPolicy) moveToMostRecentlyUsedLocked(key uint64) {
+	for i, k := range l.order {
+		if k == key {
+			l.order = append(l.order[:i], l.order[i+1:]...)
+			break
+		}
+	}
+	l.order = append(l.order, key)
+}
+
+// Evict removes the least-recently-touched series until at most l.max
+// remain.
+func (l *LRUPolicy) Evict(metric *prometheus.MetricVec) {
+	l.mu.Lock()
+	var evicted []prometheus.Labels
+	for len(l.order) > l.max {
+		key := l.order[0]
+		l.order = l.order[1:]
+		evicted = append(evicted, l.labels[key])
+		delete(l.labels, key)
+	}
+	l.mu.Unlock()
+
+	for _, labels := range evicted {
+		metric.DeletePartialMatch(labels)
+	}
+}
+
+func namedLabels(names []string, values []string) prometheus.Labels {
+	labels := make(prometheus.Labels, len(names))
+	for i, name := range names {
+		if i >= len(values) {
+			break
+		}
+		labels[name] = values[i]
+	}
+	return labels
+}
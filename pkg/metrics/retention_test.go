@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Tetragon
+
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTTLPolicyEvictsStaleSeries(t *testing.T) {
+	policy := NewTTLPolicy(10 * time.Millisecond)
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ttl_test_metric"}, []string{"pod", "namespace"})
+
+	policy.touch([]string{"pod", "namespace"}, []string{"a", "ns"})
+	vec.WithLabelValues("a", "ns").Inc()
+
+	time.Sleep(20 * time.Millisecond)
+
+	policy.touch([]string{"pod", "namespace"}, []string{"b", "ns"})
+	vec.WithLabelValues("b", "ns").Inc()
+
+	policy.Evict(vec.MetricVec)
+
+	m := &dtoCollector{}
+	gatherInto(t, vec, m)
+	if m.has("a", "ns") {
+		t.Errorf("stale series (pod=a) should have been evicted")
+	}
+	if !m.has("b", "ns") {
+		t.Errorf("fresh series (pod=b) should still be exported")
+	}
+}
+
+func TestLRUPolicyEvictsLeastRecentlyUsed(t *testing.T) {
+	policy := NewLRUPolicy(2)
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "lru_test_metric"}, []string{"pod", "namespace"})
+
+	for _, pod := range []string{"a", "b", "c"} {
+		policy.touch([]string{"pod", "namespace"}, []string{pod, "ns"})
+		vec.WithLabelValues(pod, "ns").Inc()
+	}
+
+	policy.Evict(vec.MetricVec)
+
+	m := &dtoCollector{}
+	gatherInto(t, vec, m)
+	if m.has("a", "ns") {
+		t.Errorf("least-recently-touched series (pod=a) should have been evicted once max=2 was exceeded")
+	}
+	if !m.has("b", "ns") || !m.has("c", "ns") {
+		t.Errorf("the 2 most-recently-touched series should remain, got %v", m.seen)
+	}
+}
+
+func TestLRUPolicyTouchRefreshesRecency(t *testing.T) {
+	policy := NewLRUPolicy(2)
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "lru_test_metric_refresh"}, []string{"pod", "namespace"})
+
+	for _, pod := range []string{"a", "b"} {
+		policy.touch([]string{"pod", "namespace"}, []string{pod, "ns"})
+		vec.WithLabelValues(pod, "ns").Inc()
+	}
+	// Re-touching "a" should make "b" the least-recently-used instead.
+	policy.touch([]string{"pod", "namespace"}, []string{"a", "ns"})
+	policy.touch([]string{"pod", "namespace"}, []string{"c", "ns"})
+	vec.WithLabelValues("c", "ns").Inc()
+
+	policy.Evict(vec.MetricVec)
+
+	m := &dtoCollector{}
+	gatherInto(t, vec, m)
+	if m.has("b", "ns") {
+		t.Errorf("pod=b should have been evicted as the least-recently-touched series")
+	}
+	if !m.has("a", "ns") || !m.has("c", "ns") {
+		t.Errorf("re-touched pod=a and newest pod=c should remain, got %v", m.seen)
+	}
+}
+
+// dtoCollector records which pod/namespace label-value pairs a gather call
+// observed, so tests can assert on which series survived an Evict call
+// without depending on the prometheus client's own test helpers.
+type dtoCollector struct {
+	seen [][2]string
+}
+
+func (c *dtoCollector) has(pod, namespace string) bool {
+	for _, s := range c.seen {
+		if s[0] == pod && s[1] == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func gatherInto(t *testing.T, vec *prometheus.CounterVec, c *dtoCollector) {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(vec); err != nil {
+		t.Fatalf("registering vec: %v", err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering: %v", err)
+	}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			var pod, namespace string
+			for _, label := range m.GetLabel() {
+				switch label.GetName() {
+				case "pod":
+					pod = label.GetValue()
+				case "namespace":
+					namespace = label.GetValue()
+				}
+			}
+			c.seen = append(c.seen, [2]string{pod, namespace})
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Tetragon
+
+package option
+
+import "time"
+
+// config holds the agent's metrics-related runtime configuration. Every
+// field except MetricsLabelFilter is populated from the flags registered by
+// AddMetricsFlags when ReadMetricsConfigEnv is called.
+type config struct {
+	// MetricsLabelFilter selects which of consts.KnownMetricLabelFilters are
+	// attached to Granular metrics; a label is included only if present here.
+	MetricsLabelFilter map[string]interface{}
+
+	// MetricsMaxCardinality bounds the number of distinct label-value tuples
+	// a WithPod metric will export before WithLabelValues/With start
+	// refusing new series. A value <= 0 disables the cap.
+	MetricsMaxCardinality int
+
+	// MetricsOTLPEndpoint is the OTLP collector address metrics are pushed
+	// to, e.g. "localhost:4317". Empty disables the OTLP exporter bridge.
+	MetricsOTLPEndpoint string
+	// MetricsOTLPProtocol selects "grpc" or "http"; empty defaults to grpc.
+	MetricsOTLPProtocol string
+	// MetricsOTLPInterval is how often metrics are pushed to the collector.
+	MetricsOTLPInterval time.Duration
+	// MetricsOTLPHeaders are added to every OTLP export request, e.g. for
+	// authentication with the collector.
+	MetricsOTLPHeaders map[string]string
+
+	// MetricsNativeHistogramsEnabled switches WithPod histograms to sparse
+	// native histograms instead of classic fixed buckets.
+	MetricsNativeHistogramsEnabled bool
+	// MetricsNativeHistogramsMigration keeps classic buckets alongside the
+	// native histogram fields instead of replacing them outright, so a
+	// scrape-time migration can happen gradually.
+	MetricsNativeHistogramsMigration bool
+	// MetricsNativeHistogramBucketFactor is the growth factor between
+	// adjacent native histogram buckets.
+	MetricsNativeHistogramBucketFactor float64
+	// MetricsNativeHistogramMaxBucketNumber bounds how many native
+	// histogram buckets a single series may use before the client library
+	// starts merging them.
+	MetricsNativeHistogramMaxBucketNumber uint32
+	// MetricsNativeHistogramMinResetDuration is the minimum time between
+	// automatic native histogram bucket count resets.
+	MetricsNativeHistogramMinResetDuration time.Duration
+}
+
+// Config is the agent's global runtime configuration.
+var Config = &config{
+	// Label filtering is opt-out, not opt-in: every known label filter
+	// (consts.KnownMetricLabelFilters) is enabled by default, and an
+	// individual label is disabled by removing it from this map. An
+	// empty default would silently strip "pod"/"namespace" from every
+	// WithPod metric, which in turn makes hasPodLabels think the metric
+	// isn't pod-scoped and skip registering the pod-cleanup retention
+	// policy for it.
+	MetricsLabelFilter: map[string]interface{}{
+		"pod":       struct{}{},
+		"namespace": struct{}{},
+		"binary":    struct{}{},
+		"workload":  struct{}{},
+	},
+}
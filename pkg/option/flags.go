@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Tetragon
+
+package option
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const (
+	KeyMetricsMaxCardinality = "metrics-max-cardinality"
+
+	KeyMetricsOTLPEndpoint = "metrics-otlp-endpoint"
+	KeyMetricsOTLPProtocol = "metrics-otlp-protocol"
+	KeyMetricsOTLPInterval = "metrics-otlp-interval"
+	KeyMetricsOTLPHeaders  = "metrics-otlp-headers"
+
+	KeyMetricsNativeHistogramsEnabled         = "metrics-native-histograms-enabled"
+	KeyMetricsNativeHistogramsMigration       = "metrics-native-histograms-migration"
+	KeyMetricsNativeHistogramBucketFactor     = "metrics-native-histogram-bucket-factor"
+	KeyMetricsNativeHistogramMaxBucketNumber  = "metrics-native-histogram-max-bucket-number"
+	KeyMetricsNativeHistogramMinResetDuration = "metrics-native-histogram-min-reset-duration"
+)
+
+// AddMetricsFlags registers the metrics-related flags pkg/metrics reads out
+// of Config; ReadMetricsConfigEnv copies their values into Config.
+func AddMetricsFlags(flags *pflag.FlagSet) {
+	flags.Int(KeyMetricsMaxCardinality, 0, "Max number of distinct label-value tuples a metric will export before new series are refused (0 disables the cap)")
+
+	flags.String(KeyMetricsOTLPEndpoint, "", "OTLP collector address metrics are pushed to, e.g. localhost:4317 (empty disables the OTLP exporter)")
+	flags.String(KeyMetricsOTLPProtocol, "grpc", "OTLP protocol to push metrics with (grpc or http)")
+	flags.Duration(KeyMetricsOTLPInterval, 15*time.Second, "Interval between OTLP metric pushes")
+	flags.StringToString(KeyMetricsOTLPHeaders, nil, "Headers to add to every OTLP export request, e.g. for collector authentication")
+
+	flags.Bool(KeyMetricsNativeHistogramsEnabled, false, "Export WithPod histograms as sparse native histograms instead of classic fixed buckets")
+	flags.Bool(KeyMetricsNativeHistogramsMigration, false, "Keep classic buckets alongside native histogram fields for a gradual scrape-time migration")
+	flags.Float64(KeyMetricsNativeHistogramBucketFactor, 1.1, "Growth factor between adjacent native histogram buckets")
+	flags.Uint32(KeyMetricsNativeHistogramMaxBucketNumber, 160, "Max number of native histogram buckets per series before the client library merges them")
+	flags.Duration(KeyMetricsNativeHistogramMinResetDuration, 0, "Minimum time between automatic native histogram bucket resets")
+}
+
+// ReadMetricsConfigEnv copies the metrics-related flags registered by
+// AddMetricsFlags from viper into Config.
+func ReadMetricsConfigEnv() {
+	Config.MetricsMaxCardinality = viper.GetInt(KeyMetricsMaxCardinality)
+
+	Config.MetricsOTLPEndpoint = viper.GetString(KeyMetricsOTLPEndpoint)
+	Config.MetricsOTLPProtocol = viper.GetString(KeyMetricsOTLPProtocol)
+	Config.MetricsOTLPInterval = viper.GetDuration(KeyMetricsOTLPInterval)
+	Config.MetricsOTLPHeaders = viper.GetStringMapString(KeyMetricsOTLPHeaders)
+
+	Config.MetricsNativeHistogramsEnabled = viper.GetBool(KeyMetricsNativeHistogramsEnabled)
+	Config.MetricsNativeHistogramsMigration = viper.GetBool(KeyMetricsNativeHistogramsMigration)
+	Config.MetricsNativeHistogramBucketFactor = viper.GetFloat64(KeyMetricsNativeHistogramBucketFactor)
+	Config.MetricsNativeHistogramMaxBucketNumber = uint32(viper.GetUint(KeyMetricsNativeHistogramMaxBucketNumber))
+	Config.MetricsNativeHistogramMinResetDuration = viper.GetDuration(KeyMetricsNativeHistogramMinResetDuration)
+}